@@ -15,12 +15,15 @@ potential textual suffixes for a given prefix. Consider this text:
 	I am not a number! I am a free man!
 
 Our Markov chain algorithm would arrange this text into this set of prefixes
-and suffixes, or "chain": (This table assumes a prefix length of two words.)
+and suffixes, or "chain": (This table assumes a prefix length of two words.
+<s> and </s> stand in for the actual start-of-sentence and end-of-sentence
+tokens, which pad a prefix until two real words have been seen and mark
+where one sentence ends and the next begins.)
 
 	Prefix       Suffix
 
-	"" ""        I
-	"" I         am
+	<s> <s>      I
+	<s> I        am
 	I am         a
 	I am         not
 	a free       man!
@@ -29,31 +32,75 @@ and suffixes, or "chain": (This table assumes a prefix length of two words.)
 	a number!    I
 	number! I    am
 	not a        number!
+	free man!    </s>
 
 To generate text using this table we select an initial prefix ("I am", for
 example), choose one of the suffixes associated with that prefix at random
 with probability determined by the input statistics ("a"),
 and then create a new prefix by removing the first word from the prefix
 and appending the suffix (making the new prefix is "am a"). Repeat this process
-until we can't find any suffixes for the current prefix or we exceed the word
-limit. (The word limit is necessary as the chain table may contain cycles.)
+until we draw an end-of-sentence token, can't find any suffixes for the
+current prefix, or we exceed the word limit. (The word limit is necessary
+as the chain table may contain cycles.)
 
 Our version of this program reads text from standard input, parsing it into a
 Markov chain, and writes generated text to standard output.
 The prefix and output lengths can be specified using the -prefix and -words
 flags on the command-line.
+
+Chain also implements io.Writer, so it can be trained directly from any
+source of bytes -- files, HTTP bodies, stdin, or several of these at once
+via BuildFromReaders -- rather than only from paths on disk.
+
+Models can be stored either as the original line-oriented text format or,
+with -format=gob on the read and generate commands, as a gob-encoded
+frequency table. The gob format round-trips tokens that contain spaces or
+collide with a sentinel token, and loads in time proportional to the
+number of unique prefixes rather than total tokens.
+
+The serve command (`mark serve -addr :8080 -model path`) runs a small
+HTTP server around a Chain so it can be trained and queried as a
+long-running service instead of a one-shot CLI invocation. See server.go.
 */
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/gob"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// startToken and endToken mark the beginning and end of a sentence. They
+// replace the old "" padding sentinel: rather than only padding the start
+// of the whole input, the chain now learns where sentences actually begin
+// and end, so generation can stop at a natural boundary instead of only
+// on a word count. Both are control characters, so they can never collide
+// with a token found in real text.
+const (
+	startToken = "\x02"
+	endToken   = "\x03"
 )
 
+// endsSentence reports whether word ends a sentence, based on the Unicode
+// classification of its final rune (as in the Rosetta Code "Tokenize a
+// string" Go solution).
+func endsSentence(word string) bool {
+	r, _ := utf8.DecodeLastRuneInString(word)
+	return unicode.IsPunct(r) && strings.ContainsRune(".!?", r)
+}
+
 // Prefix is a Markov chain prefix of one or more words.
 type Prefix []string
 
@@ -68,18 +115,32 @@ func (p Prefix) Shift(word string) {
 	p[len(p)-1] = word
 }
 
-// Chain contains a map ("chain") of prefixes to a list of suffixes.
-// A prefix is a string of prefixLen words joined with spaces.
+// Chain contains a frequency table ("freqTable") of prefixes to the
+// suffixes observed after them, with a count of how often each suffix
+// occurred. A prefix is a string of prefixLen words joined with spaces.
 // A suffix is a single word. A prefix can have multiple suffixes.
+//
+// mu guards freqTable, so a Chain can be trained by several goroutines at
+// once. Each training stream tracks its own rolling prefix (see
+// chainWriter) so that concurrent streams never interleave each other's
+// words; only the shared freqTable update for a completed word is
+// synchronized. The prefix and buffer of the default stream behind
+// Chain.Write and Chain.Flush are not guarded by mu.
 type Chain struct {
-	chain     map[string][]string
+	mu        sync.Mutex
 	freqTable map[string]map[string]int
 	prefixLen int
+	w         *chainWriter // default stream used when the Chain is written to directly
 }
 
 // NewChain returns a new Chain with prefixes of prefixLen words.
 func NewChain(prefixLen int) *Chain {
-	return &Chain{make(map[string][]string), make(map[string]map[string]int), prefixLen}
+	c := &Chain{
+		freqTable: make(map[string]map[string]int),
+		prefixLen: prefixLen,
+	}
+	c.w = c.newWriter()
+	return c
 }
 
 // RecordSuffixFrequency takes a prefix and a suffix and creates a
@@ -97,39 +158,146 @@ func (c *Chain) RecordSuffixFrequency(p, s string) map[string]map[string]int {
 	return c.freqTable
 }
 
-// Build reads text from the provided Reader and
-// parses it into prefixes and suffixes that are stored in Chain.
-func (c *Chain) Build(inFile string) {
+// chainWriter streams training text into a Chain. Each chainWriter owns
+// its own rolling prefix and byte buffer, so several chainWriters can
+// train the same Chain concurrently without their token streams
+// interleaving; only the freqTable update for a completed word is shared,
+// under c.mu.
+type chainWriter struct {
+	c      *Chain
+	prefix Prefix
+	buf    []byte // bytes not yet resolved into a complete word
+}
 
-	file, err := os.Open(inFile)
-	if err != nil {
-		fmt.Println("Error:  opening the file.")
+// newWriter returns a chainWriter with a fresh rolling prefix, ready to
+// train c from its own, independent stream of text.
+func (c *Chain) newWriter() *chainWriter {
+	prefix := make(Prefix, c.prefixLen)
+	for i := range prefix {
+		prefix[i] = startToken
 	}
+	return &chainWriter{c: c, prefix: prefix}
+}
 
-	defer file.Close()
+// addWord records word as the suffix of w's current rolling prefix, then
+// shifts word into the prefix. If word ends a sentence, an endToken is
+// recorded after it and the prefix resets to startToken padding, so the
+// next word begins a fresh sentence. Only the freqTable update is taken
+// under w.c.mu; w's own prefix is unshared.
+func (w *chainWriter) addWord(word string) {
+	c := w.c
+
+	c.mu.Lock()
+	c.freqTable = c.RecordSuffixFrequency(w.prefix.String(), word)
+	c.mu.Unlock()
+	w.prefix.Shift(word)
+
+	if endsSentence(word) {
+		c.mu.Lock()
+		c.freqTable = c.RecordSuffixFrequency(w.prefix.String(), endToken)
+		c.mu.Unlock()
+		w.prefix.Shift(endToken)
+
+		for i := range w.prefix {
+			w.prefix[i] = startToken
+		}
+	}
+}
 
-	br := bufio.NewReader(file)
+// Write implements io.Writer, feeding p into w's training stream. Write
+// may be called with arbitrary chunk boundaries: a word split across two
+// calls is buffered until it is completed by a later one.
+func (w *chainWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	w.buf = append(w.buf, p...)
 
-	p := make(Prefix, c.prefixLen)
-	for i := range p {
-		p[i] = "\"\""
+	end := bytes.LastIndexAny(w.buf, " \t\n\r")
+	if end < 0 {
+		return n, nil
 	}
 
-	for {
-		var s string
-		if _, err := fmt.Fscan(br, &s); err != nil {
-			break
-		}
-		prefixKey := p.String()
+	for _, word := range strings.Fields(string(w.buf[:end])) {
+		w.addWord(word)
+	}
+	w.buf = append(w.buf[:0], w.buf[end+1:]...)
+
+	return n, nil
+}
+
+// Flush ingests any word left buffered by a previous Write that was not
+// terminated by trailing whitespace.
+func (w *chainWriter) Flush() {
+	if word := strings.TrimSpace(string(w.buf)); word != "" {
+		w.addWord(word)
+	}
+	w.buf = w.buf[:0]
+}
+
+// Write implements io.Writer on the Chain's default training stream,
+// feeding p into it as more training text. Use this directly, alongside
+// Flush, when streaming one logical source into the chain one chunk at a
+// time; Build is preferred when the whole source is available as a single
+// io.Reader, since it trains through its own independent stream instead
+// of this shared one.
+func (c *Chain) Write(p []byte) (n int, err error) {
+	return c.w.Write(p)
+}
 
-		c.chain[prefixKey] = append(c.chain[prefixKey], s)
-		c.freqTable = c.RecordSuffixFrequency(prefixKey, s)
+// Flush ingests any word left buffered on the Chain's default training
+// stream by a previous Write that was not terminated by trailing
+// whitespace.
+func (c *Chain) Flush() {
+	c.w.Flush()
+}
 
-		// fmt.Println(prefixKey, c.chain[prefixKey]) // for testing
+// Build reads text from r and parses it into prefixes and suffixes that
+// are stored in Chain. Each call to Build trains through its own,
+// freshly created chainWriter, so independent calls -- reading separate
+// files, or separate HTTP requests to a server's /train endpoint -- never
+// splice a prefix across the boundary between them. Build is safe to call
+// concurrently, including concurrently with itself and with
+// BuildFromReaders, which trains readers through their own streams too.
+func (c *Chain) Build(r io.Reader) error {
+	w := c.newWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
 
-		p.Shift(s)
+// BuildFromReaders trains the chain from readers concurrently, one
+// goroutine per reader, and waits for all of them to finish. This lets
+// callers train from HTTP streams, stdin, or many files at once without
+// serial file opens. Each reader trains through its own chainWriter, so
+// their prefixes never interleave; only the completed-word updates to the
+// shared freqTable are synchronized, making the resulting model the same
+// regardless of how the goroutines happen to be scheduled.
+func (c *Chain) BuildFromReaders(readers ...io.Reader) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(readers))
+
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			w := c.newWriter()
+			if _, err := io.Copy(w, r); err != nil {
+				errs <- err
+				return
+			}
+			w.Flush()
+		}(r)
 	}
 
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // StoreFrequencyTable translates creates a file called filname
@@ -155,6 +323,78 @@ func (c *Chain) StoreFrequencyTable(filename string) {
 	}
 }
 
+// gobFormatVersion identifies the layout SaveGob writes, so LoadGob can
+// reject files written by an incompatible future version.
+const gobFormatVersion = 1
+
+// gobHeader precedes the encoded frequency table in a gob model file.
+type gobHeader struct {
+	Version   int
+	PrefixLen int
+}
+
+func init() {
+	gob.Register(map[string]map[string]int{})
+}
+
+// encodeGob writes the chain's frequency table to w using encoding/gob.
+func (c *Chain) encodeGob(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(gobHeader{Version: gobFormatVersion, PrefixLen: c.prefixLen}); err != nil {
+		return err
+	}
+	return enc.Encode(c.freqTable)
+}
+
+// decodeGobChain reads a chain previously written by encodeGob from r.
+func decodeGobChain(r io.Reader) (*Chain, error) {
+	dec := gob.NewDecoder(r)
+	var header gobHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != gobFormatVersion {
+		return nil, fmt.Errorf("mark: unsupported gob format version %d", header.Version)
+	}
+
+	c := NewChain(header.PrefixLen)
+	if err := dec.Decode(&c.freqTable); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SaveGob creates path and writes the chain's header (gobFormatVersion
+// and prefixLen) followed by its frequency table to it, via encodeGob.
+func (c *Chain) SaveGob(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return c.encodeGob(out)
+}
+
+// LoadGob loads a chain previously written by SaveGob.
+func LoadGob(path string) (*Chain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeGobChain(file)
+}
+
+// ReadFrequencyTableFromFile loads a frequency table previously written by
+// StoreFrequencyTable. Unlike the old format loader, the counts are kept
+// intact in freqTable rather than expanded into a repeated suffix slice,
+// so memory use is proportional to the number of unique suffixes rather
+// than the number of tokens seen during training.
 func ReadFrequencyTableFromFile(filename string) *Chain {
 
 	file, err := os.Open(filename)
@@ -177,21 +417,21 @@ func ReadFrequencyTableFromFile(filename string) *Chain {
 		line := strings.Split(currentLine, " ")
 
 		for i := 0; i < prefixLen; i++ {
-			if line[i] == "\"\"" {
-				line[i] = ""
-			}
 			p[i] = line[i]
 		}
 		prefixKey := p.String()
+		freqMap, ok := c.freqTable[prefixKey]
+		if !ok {
+			freqMap = make(map[string]int)
+			c.freqTable[prefixKey] = freqMap
+		}
 		for i := prefixLen; i < len(line); i++ {
 			suffix := line[i]
 			freq, err := strconv.Atoi(line[i+1])
 			if err != nil {
 				panic(err)
 			}
-			for j := 0; j < freq; j++ {
-				c.chain[prefixKey] = append(c.chain[prefixKey], suffix)
-			}
+			freqMap[suffix] = freq
 			i++
 		}
 	}
@@ -199,19 +439,62 @@ func ReadFrequencyTableFromFile(filename string) *Chain {
 	return c
 }
 
-// Generate returns a string of at most n words generated from modelFile.
-func Generate(filename string, n int) string {
+// nextSuffix draws a suffix for prefixKey, weighted by how often each
+// suffix followed that prefix during training. Callers supply rng so that
+// generation can be made reproducible; to hold up that guarantee, the
+// suffixes are walked in sorted order rather than Go's randomized map
+// iteration order, which would otherwise assign each suffix a different,
+// run-dependent slice of rng's draw. nextSuffix takes c.mu so it can be
+// called safely while other goroutines are training the same chain.
+func (c *Chain) nextSuffix(rng *rand.Rand, prefixKey string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	freqMap := c.freqTable[prefixKey]
+	if len(freqMap) == 0 {
+		return "", false
+	}
 
-	c := ReadFrequencyTableFromFile(filename)
+	suffixes := make([]string, 0, len(freqMap))
+	for suffix := range freqMap {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	total := 0
+	for _, suffix := range suffixes {
+		total += freqMap[suffix]
+	}
+
+	r := rng.Intn(total)
+	for _, suffix := range suffixes {
+		r -= freqMap[suffix]
+		if r < 0 {
+			return suffix, true
+		}
+	}
+
+	panic("unreachable: weights did not sum to total")
+}
+
+// GenerateN returns a string of at most n words generated from the chain,
+// drawing suffixes with probability proportional to their observed
+// frequency. rng is seeded from seed, so the same seed always reproduces
+// the same output.
+func (c *Chain) GenerateN(n int, seed int64) string {
+	rng := rand.New(rand.NewSource(seed))
 
 	p := make(Prefix, c.prefixLen)
+	for i := range p {
+		p[i] = startToken
+	}
+
 	var words []string
 	for i := 0; i < n; i++ {
-		choices := c.chain[p.String()]
-		if len(choices) == 0 {
+		next, ok := c.nextSuffix(rng, p.String())
+		if !ok || next == endToken {
 			break
 		}
-		next := choices[rand.Intn(len(choices))]
 		words = append(words, next)
 		p.Shift(next)
 	}
@@ -219,28 +502,148 @@ func Generate(filename string, n int) string {
 	return strings.Join(words, " ")
 }
 
-func main() {
+// backoffPrefix finds a usable starting Prefix for seedWords. It first
+// tries the chain's prefixLen trailing words of seedWords; if the chain
+// never saw that exact sequence, it backs off to fewer trailing words
+// (padding the front with startToken), down to the bare chain-start
+// prefix, which is always present in a trained chain. usedSeed reports
+// whether any of the seed's own words were used to reach the returned
+// prefix, as opposed to falling all the way back to the chain start.
+// p is nil if the chain has no training data at all.
+func (c *Chain) backoffPrefix(seedWords []string) (p Prefix, usedSeed bool) {
+	for k := c.prefixLen; k >= 0; k-- {
+		cand := make(Prefix, c.prefixLen)
+		for i := range cand {
+			cand[i] = startToken
+		}
+		tail := seedWords
+		if len(tail) > k {
+			tail = tail[len(tail)-k:]
+		}
+		for _, word := range tail {
+			cand.Shift(word)
+		}
 
-	command := os.Args[1]
+		c.mu.Lock()
+		_, hasContinuation := c.freqTable[cand.String()]
+		c.mu.Unlock()
+		if hasContinuation {
+			return cand, len(tail) > 0
+		}
+	}
+	return nil, false
+}
 
-	if command == "read" {
-		prefixLen, _ := strconv.Atoi(os.Args[2]) // gives value and err
-		outfile := os.Args[3]
+// GenerateFrom continues generation from seed, a space-separated prompt.
+// It locates the best matching prefix for seed via backoffPrefix and
+// produces at most n further words from there, stopping as soon as it
+// draws an end-of-sentence token so it naturally produces well-formed
+// sentences instead of runs cut off mid-clause.
+//
+// ok reports whether the seed's own words were actually found in the
+// chain and used to anchor generation. If the seed was never trained on,
+// GenerateFrom still produces text by falling back to the chain start,
+// but returns ok=false so callers can surface that the seed was not
+// matched rather than silently treating the result as a real completion
+// of the prompt. If the chain has no training data at all, GenerateFrom
+// returns the seed unchanged with ok=false.
+func (c *Chain) GenerateFrom(seed string, n int) (text string, ok bool) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	seedWords := strings.Fields(seed)
+	p, usedSeed := c.backoffPrefix(seedWords)
+	if p == nil {
+		return seed, false
+	}
 
-		c := NewChain(prefixLen)
-		for i := 4; i < len(os.Args); i++ {
-			c.Build(os.Args[i])
+	words := append([]string(nil), seedWords...)
+	for i := 0; i < n; i++ {
+		next, ok := c.nextSuffix(rng, p.String())
+		if !ok || next == endToken {
+			break
 		}
-		c.StoreFrequencyTable(outfile)
+		words = append(words, next)
+		p.Shift(next)
+	}
 
-	} else if command == "generate" {
-		modelFile := os.Args[2]
-		numWords, _ := strconv.Atoi(os.Args[3])
+	return strings.Join(words, " "), usedSeed
+}
 
-		text := Generate(modelFile, numWords) // Generate text.
-		fmt.Println(text)                     // Write text to standard output.
+// Generate returns a string of at most n words generated from modelFile.
+func Generate(filename string, n int) string {
+	c := ReadFrequencyTableFromFile(filename)
+	return c.GenerateN(n, time.Now().UnixNano())
+}
 
-	} else {
+func main() {
+
+	if len(os.Args) < 2 {
+		panic("Invalid command")
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	switch command {
+	case "read":
+		readCommand(args)
+	case "generate":
+		generateCommand(args)
+	case "serve":
+		serveCommand(args)
+	default:
 		panic("Invalid command")
 	}
 }
+
+// readCommand implements `mark read [-format=text|gob] prefixLen outfile infile...`.
+func readCommand(args []string) {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	format := fs.String("format", "text", "model format to write: text or gob")
+	fs.Parse(args)
+	rest := fs.Args()
+
+	prefixLen, _ := strconv.Atoi(rest[0]) // gives value and err
+	outfile := rest[1]
+
+	c := NewChain(prefixLen)
+	for _, path := range rest[2:] {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Println("Error:  opening the file.")
+			continue
+		}
+		if err := c.Build(file); err != nil {
+			fmt.Println("Error:  reading the file.")
+		}
+		file.Close()
+	}
+
+	if *format == "gob" {
+		if err := c.SaveGob(outfile); err != nil {
+			fmt.Println("Error:  saving the model:", err)
+		}
+		return
+	}
+	c.StoreFrequencyTable(outfile)
+}
+
+// generateCommand implements `mark generate [-format=text|gob] modelFile numWords`.
+func generateCommand(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	format := fs.String("format", "text", "model format to read: text or gob")
+	fs.Parse(args)
+	rest := fs.Args()
+
+	modelFile := rest[0]
+	numWords, _ := strconv.Atoi(rest[1])
+
+	if *format == "gob" {
+		c, err := LoadGob(modelFile)
+		if err != nil {
+			fmt.Println("Error:  loading the model:", err)
+			return
+		}
+		fmt.Println(c.GenerateN(numWords, time.Now().UnixNano()))
+		return
+	}
+	fmt.Println(Generate(modelFile, numWords)) // Generate text and write to standard output.
+}
@@ -0,0 +1,160 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server wraps a Chain behind HTTP handlers, so it can be trained and
+// queried concurrently and its model swapped out atomically via
+// /model import.
+type server struct {
+	mu    sync.RWMutex
+	chain *Chain
+	path  string // file the chain is periodically persisted to, in gob format
+}
+
+func newServer(prefixLen int, path string) *server {
+	return &server{chain: NewChain(prefixLen), path: path}
+}
+
+// current returns the server's chain under a read lock, so handlers never
+// observe a chain mid-swap from a concurrent /model import.
+func (s *server) current() *Chain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.chain
+}
+
+// handleTrain implements POST /train: the request body is read as more
+// training text for the chain. Each request trains through Build's own
+// freshly created stream, so the rolling prefix from one /train request
+// never bleeds into the next.
+func (s *server) handleTrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.current().Build(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGenerate implements GET /generate?n=50&seed=...: n caps the number
+// of words generated (default 50), and seed, if given, is used to locate
+// a starting prefix via GenerateFrom instead of starting from scratch. If
+// seed was never trained on, the response still contains generated text
+// (GenerateFrom falls back to the chain start) but is flagged as such, so
+// callers don't mistake it for a genuine completion of their prompt. The
+// response is JSON if the request's Accept header asks for it, and plain
+// text otherwise.
+func (s *server) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 50
+	}
+
+	chain := s.current()
+	seed := r.URL.Query().Get("seed")
+	text, seedMatched := "", true
+	if seed != "" {
+		text, seedMatched = chain.GenerateFrom(seed, n)
+	} else {
+		text = chain.GenerateN(n, time.Now().UnixNano())
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Text        string `json:"text"`
+			SeedMatched bool   `json:"seedMatched"`
+		}{text, seedMatched})
+		return
+	}
+	if !seedMatched {
+		fmt.Fprintln(w, text, "(seed not found in model; continued from chain start)")
+		return
+	}
+	fmt.Fprintln(w, text)
+}
+
+// handleModel implements GET /model (gob export of the current chain) and
+// POST /model (gob import, atomically replacing the current chain).
+func (s *server) handleModel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := s.current().encodeGob(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		chain, err := decodeGobChain(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.chain = chain
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+	}
+}
+
+// persistPeriodically saves the current chain to s.path, in gob format,
+// every interval until the process exits. It is a no-op if s.path is empty.
+func (s *server) persistPeriodically(interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := s.current().SaveGob(s.path); err != nil {
+			fmt.Println("Error:  persisting the model:", err)
+		}
+	}
+}
+
+// serveCommand implements `mark serve [-addr :8080] [-model path] [-prefix 2] [-persist 1m]`.
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	modelPath := fs.String("model", "", "path to load at startup and periodically persist the model to")
+	prefixLen := fs.Int("prefix", 2, "prefix length for a newly created model")
+	persist := fs.Duration("persist", time.Minute, "how often to persist the model to -model")
+	fs.Parse(args)
+
+	srv := newServer(*prefixLen, *modelPath)
+	if *modelPath != "" {
+		if chain, err := LoadGob(*modelPath); err == nil {
+			srv.chain = chain
+		}
+	}
+
+	go srv.persistPeriodically(*persist)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/train", srv.handleTrain)
+	mux.HandleFunc("/generate", srv.handleGenerate)
+	mux.HandleFunc("/model", srv.handleModel)
+
+	fmt.Println("mark: listening on", *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fmt.Println("Error:  serving:", err)
+	}
+}